@@ -0,0 +1,42 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package certchain declares the boundary between "something that can
+// obtain a certificate chain" and the cert manager that consumes it, so the
+// two can vary independently: certfetcher's CertFetcher obtains chains from
+// an ACME CA, and certfetcher's CachingFetcher wraps any RawChainSource with
+// a cache, without the cert manager needing to know which it's talking to.
+package certchain
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+)
+
+// RawChain is a leaf certificate and the intermediates needed to chain it up
+// to a trust anchor, as returned by the CA at issuance time, along with when
+// the CA issued it.
+type RawChain struct {
+	Leaf          []byte
+	Intermediates [][]byte
+	IssuedAt      time.Time
+}
+
+// RawChainSource obtains a certificate chain for csr. Implementations may
+// hit a CA on every call (like CertFetcher) or serve from a cache (like
+// CachingFetcher).
+type RawChainSource interface {
+	Fetch(ctx context.Context, csr *x509.CertificateRequest) (*RawChain, error)
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"crypto"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/pkg/errors"
+)
+
+// AccountState is everything about an ACME account that needs to survive a
+// process restart: the CA's registration record, the account's private key,
+// and when (and to what ToS URL) the account holder agreed.
+type AccountState struct {
+	Registration      *registration.Resource
+	PrivateKey        crypto.PrivateKey
+	TermsOfServiceURL string
+	AgreedAt          time.Time
+}
+
+// AccountStorage persists and retrieves ACME AccountState, keyed by the CA
+// directory URL and the account's email address. Implementations should
+// return os.ErrNotExist (or an error satisfying errors.Is(err,
+// os.ErrNotExist)) from Load when no account has been saved yet.
+type AccountStorage interface {
+	Load(caDirURL, email string) (*AccountState, error)
+	Save(caDirURL, email string, state *AccountState) error
+}
+
+// FileAccountStorage is the default AccountStorage: it writes account.json
+// (and the account's PEM-encoded private key) under Dir, laid out the same
+// way lego's own CLI does -- by CA host, then by email -- so that an
+// account registered with lego's CLI can be picked up here and vice versa:
+//
+//	Dir/<CA host>/<email>/account.json
+//	Dir/<CA host>/<email>/keys/<email>.key
+type FileAccountStorage struct {
+	Dir string
+}
+
+func (s *FileAccountStorage) accountDir(caDirURL, email string) (string, error) {
+	u, err := url.Parse(caDirURL)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing ACME directory URL")
+	}
+	return filepath.Join(s.Dir, u.Host, email), nil
+}
+
+// accountFile mirrors lego's own account.json layout closely enough to be
+// read by lego's CLI, but only carries the fields CertFetcher needs.
+type accountFile struct {
+	Email             string                 `json:"Email"`
+	Registration      *registration.Resource `json:"Registration"`
+	TermsOfServiceURL string                 `json:"TermsOfServiceURL"`
+	AgreedAt          time.Time              `json:"AgreedAt"`
+}
+
+func (s *FileAccountStorage) Load(caDirURL, email string) (*AccountState, error) {
+	dir, err := s.accountDir(caDirURL, email)
+	if err != nil {
+		return nil, err
+	}
+
+	accountBytes, err := os.ReadFile(filepath.Join(dir, "account.json"))
+	if err != nil {
+		return nil, err
+	}
+	var account accountFile
+	if err := json.Unmarshal(accountBytes, &account); err != nil {
+		return nil, errors.Wrap(err, "parsing account.json")
+	}
+
+	keyBytes, err := os.ReadFile(filepath.Join(dir, "keys", email+".key"))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading account key")
+	}
+	key, err := certcrypto.ParsePEMPrivateKey(keyBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing account key")
+	}
+
+	return &AccountState{
+		Registration:      account.Registration,
+		PrivateKey:        key,
+		TermsOfServiceURL: account.TermsOfServiceURL,
+		AgreedAt:          account.AgreedAt,
+	}, nil
+}
+
+func (s *FileAccountStorage) Save(caDirURL, email string, state *AccountState) error {
+	dir, err := s.accountDir(caDirURL, email)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "keys"), 0700); err != nil {
+		return errors.Wrap(err, "creating account directory")
+	}
+
+	account := accountFile{
+		Email:             email,
+		Registration:      state.Registration,
+		TermsOfServiceURL: state.TermsOfServiceURL,
+		AgreedAt:          state.AgreedAt,
+	}
+	accountBytes, err := json.MarshalIndent(account, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding account.json")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "account.json"), accountBytes, 0600); err != nil {
+		return errors.Wrap(err, "writing account.json")
+	}
+
+	keyBytes := certcrypto.PEMEncode(state.PrivateKey.(crypto.Signer))
+	if err := os.WriteFile(filepath.Join(dir, "keys", email+".key"), keyBytes, 0600); err != nil {
+		return errors.Wrap(err, "writing account key")
+	}
+
+	return nil
+}
+
+// SaveAccount persists u to storage under caDirURL, so a future LoadAccount
+// call can restore it without contacting the CA.
+func (u *AcmeUser) SaveAccount(storage AccountStorage, caDirURL string) error {
+	return storage.Save(caDirURL, u.Email, &AccountState{
+		Registration:      u.Registration,
+		PrivateKey:        u.key,
+		TermsOfServiceURL: u.TermsOfServiceURL,
+		AgreedAt:          u.AgreedAt,
+	})
+}
+
+// LoadAccount restores u from storage under caDirURL. It returns false,
+// nil if no account has been saved yet.
+func (u *AcmeUser) LoadAccount(storage AccountStorage, caDirURL string) (bool, error) {
+	state, err := storage.Load(caDirURL, u.Email)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	u.Registration = state.Registration
+	u.key = state.PrivateKey
+	u.TermsOfServiceURL = state.TermsOfServiceURL
+	u.AgreedAt = state.AgreedAt
+	return true, nil
+}
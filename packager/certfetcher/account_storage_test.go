@@ -0,0 +1,84 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/registration"
+)
+
+func TestFileAccountStorageSaveLoadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	storage := &FileAccountStorage{Dir: dir}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agreedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	user := &AcmeUser{
+		Email:             "ops@example.com",
+		Registration:      &registration.Resource{URI: "https://ca.example/acme/acct/1"},
+		key:               key,
+		TermsOfServiceURL: "https://ca.example/tos",
+		AgreedAt:          agreedAt,
+	}
+
+	caDirURL := "https://ca.example/directory"
+	if err := user.SaveAccount(storage, caDirURL); err != nil {
+		t.Fatalf("SaveAccount: %v", err)
+	}
+
+	loaded := &AcmeUser{Email: user.Email}
+	found, err := loaded.LoadAccount(storage, caDirURL)
+	if err != nil {
+		t.Fatalf("LoadAccount: %v", err)
+	}
+	if !found {
+		t.Fatal("expected to find saved account")
+	}
+
+	if loaded.Registration.URI != user.Registration.URI {
+		t.Errorf("Registration.URI = %q, want %q", loaded.Registration.URI, user.Registration.URI)
+	}
+	if loaded.TermsOfServiceURL != user.TermsOfServiceURL {
+		t.Errorf("TermsOfServiceURL = %q, want %q", loaded.TermsOfServiceURL, user.TermsOfServiceURL)
+	}
+	if !loaded.AgreedAt.Equal(agreedAt) {
+		t.Errorf("AgreedAt = %v, want %v", loaded.AgreedAt, agreedAt)
+	}
+	if loaded.GetPrivateKey() == nil {
+		t.Error("expected a private key to be loaded")
+	}
+}
+
+func TestFileAccountStorageLoadMissing(t *testing.T) {
+	dir := t.TempDir()
+	storage := &FileAccountStorage{Dir: dir}
+	user := &AcmeUser{Email: "ops@example.com"}
+	found, err := user.LoadAccount(storage, "https://ca.example/directory")
+	if err != nil {
+		t.Fatalf("LoadAccount: %v", err)
+	}
+	if found {
+		t.Error("expected no account to be found")
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/certchain"
+	"github.com/pkg/errors"
+)
+
+// Cache stores the most recently fetched RawChain for a given key (the
+// caller decides what the key means -- typically the CSR's public key
+// fingerprint or the domain it's for). Implementations need not evict; a
+// cache holds at most one chain per key, and CachingFetcher overwrites it on
+// every refresh.
+type Cache interface {
+	Get(key string) (*certchain.RawChain, bool, error)
+	Set(key string, chain *certchain.RawChain) error
+}
+
+// MemoryCache is a Cache backed by a single in-process map. It's useful for
+// a single amppackager process; DiskCache is useful for sharing one issued
+// certificate across multiple processes or machines.
+type MemoryCache struct {
+	mu     sync.Mutex
+	chains map[string]*certchain.RawChain
+}
+
+func (c *MemoryCache) Get(key string) (*certchain.RawChain, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	chain, ok := c.chains[key]
+	return chain, ok, nil
+}
+
+func (c *MemoryCache) Set(key string, chain *certchain.RawChain) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.chains == nil {
+		c.chains = make(map[string]*certchain.RawChain)
+	}
+	c.chains[key] = chain
+	return nil
+}
+
+// DiskCache is a Cache backed by a single JSON file at CertPath, guarded by
+// a lock file at LockPath so that multiple amppackager instances sharing
+// CertPath (e.g. on shared network storage, behind a load balancer) don't
+// clobber each other's writes or read a half-written file.
+type DiskCache struct {
+	CertPath string
+	LockPath string
+}
+
+// diskCacheLockWait is how long DiskCache retries acquiring its lock file
+// before giving up.
+const diskCacheLockWait = 10 * time.Second
+
+// diskCacheLockStaleAfter is how old an uncontested lock file's mtime has to
+// be before DiskCache assumes its creator crashed without cleaning up, and
+// reclaims it. Without this, one crashed instance permanently wedges every
+// other instance sharing CertPath until an operator removes the lock file by
+// hand.
+const diskCacheLockStaleAfter = 30 * time.Second
+
+// newLockToken returns a value unique to this acquisition attempt, so a
+// lock file can be told apart from whatever else might later occupy the
+// same path.
+func newLockToken() string {
+	var nonce [16]byte
+	_, _ = rand.Read(nonce[:])
+	return fmt.Sprintf("%d-%x", os.Getpid(), nonce)
+}
+
+func (c *DiskCache) lock() (unlock func(), err error) {
+	token := newLockToken()
+	deadline := time.Now().Add(diskCacheLockWait)
+	for {
+		f, err := os.OpenFile(c.LockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, writeErr := f.WriteString(token)
+			f.Close()
+			if writeErr != nil {
+				os.Remove(c.LockPath)
+				return nil, errors.Wrap(writeErr, "writing cache lock token")
+			}
+			return func() { c.unlockIfHeldBy(token) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, errors.Wrap(err, "creating cache lock file")
+		}
+
+		if lf, openErr := os.Open(c.LockPath); openErr == nil {
+			// Reclaim a lock file old enough that its creator has almost
+			// certainly crashed rather than merely being slow. The mtime and
+			// the token are read through the same open file, so the token is
+			// the one we observed as stale; verify the lock still holds it
+			// before removing it: if the holder finished and released it (or
+			// another waiter already reclaimed it) in between, its
+			// replacement is live and must be left alone.
+			info, statErr := lf.Stat()
+			held, readErr := io.ReadAll(lf)
+			lf.Close()
+			if statErr == nil && readErr == nil && time.Since(info.ModTime()) > diskCacheLockStaleAfter {
+				c.unlockIfHeldBy(string(held))
+				continue
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("timed out waiting for lock file %s", c.LockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// unlockIfHeldBy removes the lock file only if it still holds token, so a
+// holder (or a waiter reclaiming a stale lock) never deletes a lock it
+// doesn't actually own -- e.g. one that's since been reclaimed by another
+// waiter, or recreated by a new holder.
+func (c *DiskCache) unlockIfHeldBy(token string) {
+	held, err := os.ReadFile(c.LockPath)
+	if err != nil || string(held) != token {
+		return
+	}
+	os.Remove(c.LockPath)
+}
+
+func (c *DiskCache) Get(key string) (*certchain.RawChain, bool, error) {
+	unlock, err := c.lock()
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
+
+	entries, err := c.readLocked()
+	if err != nil {
+		return nil, false, err
+	}
+	chain, ok := entries[key]
+	return chain, ok, nil
+}
+
+func (c *DiskCache) Set(key string, chain *certchain.RawChain) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := c.readLocked()
+	if err != nil {
+		return err
+	}
+	if entries == nil {
+		entries = make(map[string]*certchain.RawChain)
+	}
+	entries[key] = chain
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "encoding cached certificate")
+	}
+	if err := os.WriteFile(c.CertPath, data, 0600); err != nil {
+		return errors.Wrap(err, "writing cached certificate")
+	}
+	return nil
+}
+
+// readLocked must be called with the cache's lock file held.
+func (c *DiskCache) readLocked() (map[string]*certchain.RawChain, error) {
+	data, err := os.ReadFile(c.CertPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading cached certificate")
+	}
+	var entries map[string]*certchain.RawChain
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Wrap(err, "parsing cached certificate")
+	}
+	return entries, nil
+}
+
+// DefaultShouldRefresh reports whether cert has less than 30% of its
+// validity period remaining, the same threshold the SXG cert manager itself
+// uses to decide when to renew.
+func DefaultShouldRefresh(cert *x509.Certificate) bool {
+	validity := cert.NotAfter.Sub(cert.NotBefore)
+	remaining := time.Until(cert.NotAfter)
+	return remaining*10 < validity*3
+}
+
+// CachingFetcher wraps a certchain.RawChainSource with a Cache, so that
+// repeated Fetch calls -- e.g. on every cert manager renewal tick, or across
+// multiple amppackager instances sharing a DiskCache -- reuse the last
+// issued chain until ShouldRefresh says it's time to ask Source again. This
+// is what lets multiple amppackager instances behind a load balancer share
+// one issued certificate rather than each fetching (and counting against
+// the CA's rate limits) on their own.
+type CachingFetcher struct {
+	Source certchain.RawChainSource
+	Cache  Cache
+	// ShouldRefresh decides whether a cached chain is stale enough to
+	// re-fetch. Defaults to DefaultShouldRefresh if nil.
+	ShouldRefresh func(*x509.Certificate) bool
+	// Key identifies the cache entry for a given CSR, e.g. by domain name.
+	// It must be deterministic for a given csr.
+	Key func(csr *x509.CertificateRequest) string
+}
+
+func (f *CachingFetcher) shouldRefresh(cert *x509.Certificate) bool {
+	if f.ShouldRefresh != nil {
+		return f.ShouldRefresh(cert)
+	}
+	return DefaultShouldRefresh(cert)
+}
+
+// Fetch implements certchain.RawChainSource.
+func (f *CachingFetcher) Fetch(ctx context.Context, csr *x509.CertificateRequest) (*certchain.RawChain, error) {
+	key := f.Key(csr)
+
+	cached, ok, err := f.Cache.Get(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading certificate cache")
+	}
+	if ok {
+		leaf, err := x509.ParseCertificate(cached.Leaf)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing cached certificate")
+		}
+		if !f.shouldRefresh(leaf) {
+			return cached, nil
+		}
+	}
+
+	chain, err := f.Source.Fetch(ctx, csr)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Cache.Set(key, chain); err != nil {
+		return nil, errors.Wrap(err, "writing certificate cache")
+	}
+	return chain, nil
+}
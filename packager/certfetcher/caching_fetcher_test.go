@@ -0,0 +1,81 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/certchain"
+)
+
+func TestDiskCacheGetSetRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	cache := &DiskCache{
+		CertPath: filepath.Join(dir, "cert.json"),
+		LockPath: filepath.Join(dir, "cert.lock"),
+	}
+
+	if _, ok, err := cache.Get("example.com"); err != nil || ok {
+		t.Fatalf("Get on empty cache = (%v, %v), want (false, nil)", ok, err)
+	}
+
+	chain := &certchain.RawChain{Leaf: []byte("leaf"), Intermediates: [][]byte{[]byte("intermediate")}}
+	if err := cache.Set("example.com", chain); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	got, ok, err := cache.Get("example.com")
+	if err != nil || !ok {
+		t.Fatalf("Get after Set = (%v, %v), want (true, nil)", ok, err)
+	}
+	if string(got.Leaf) != "leaf" {
+		t.Errorf("Leaf = %q, want %q", got.Leaf, "leaf")
+	}
+}
+
+func TestDiskCacheReclaimsStaleLock(t *testing.T) {
+	dir := t.TempDir()
+	cache := &DiskCache{
+		CertPath: filepath.Join(dir, "cert.json"),
+		LockPath: filepath.Join(dir, "cert.lock"),
+	}
+
+	// Simulate a lock file left behind by a crashed process: old enough to
+	// be well past diskCacheLockStaleAfter.
+	if err := os.WriteFile(cache.LockPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	staleTime := time.Now().Add(-2 * diskCacheLockStaleAfter)
+	if err := os.Chtimes(cache.LockPath, staleTime, staleTime); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cache.Set("example.com", &certchain.RawChain{Leaf: []byte("leaf")})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	case <-time.After(diskCacheLockWait):
+		t.Fatal("Set did not reclaim the stale lock before diskCacheLockWait elapsed")
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"context"
+	"crypto/x509"
+
+	"github.com/ampproject/amppackager/packager/certchain"
+	"github.com/pkg/errors"
+)
+
+// Fetch implements certchain.RawChainSource, so a CertFetcher can be handed
+// to a CachingFetcher (or any other code written against RawChainSource)
+// without it needing to know it's talking to an ACME CA specifically. csr is
+// ignored in favor of f.CertSignRequest, which New/SetCSR already
+// configured; it's accepted so the signature matches RawChainSource.
+func (f *CertFetcher) Fetch(ctx context.Context, csr *x509.CertificateRequest) (*certchain.RawChain, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	chain, err := f.FetchNewCert()
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("No certificates were returned.")
+	}
+
+	raw := &certchain.RawChain{
+		Leaf:     chain[0].Raw,
+		IssuedAt: chain[0].NotBefore,
+	}
+	for _, intermediate := range chain[1:] {
+		raw.Intermediates = append(raw.Intermediates, intermediate.Raw)
+	}
+	return raw, nil
+}
@@ -17,24 +17,34 @@ package certfetcher
 import (
 	"crypto"
 	"crypto/x509"
-	"strconv"
+	"log"
+	"time"
 
 	"github.com/WICG/webpackage/go/signedexchange"
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
-	"github.com/go-acme/lego/v4/challenge/http01"
-	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
 	"github.com/go-acme/lego/v4/lego"
-	"github.com/go-acme/lego/v4/providers/http/webroot"
 	"github.com/go-acme/lego/v4/registration"
 	"github.com/pkg/errors"
 )
 
+// CertFetcher is built up via NewCertFetcher() and the Set.../Add... methods
+// below, then finalized with Register(). It is not safe for concurrent use
+// while being built; the resulting, fully-built value is safe to call
+// FetchNewCert on from multiple goroutines.
 type CertFetcher struct {
 	AcmeDiscoveryURL string
 	AcmeUser         AcmeUser
 	legoClient       *lego.Client
 	CertSignRequest  *x509.CertificateRequest
+
+	solvers           []challengeSolver
+	accountStorage    AccountStorage
+	fetchOptions      *FetchOptions
+	http01Provider    *inProcessHTTP01Provider
+	tlsALPN01Provider *inProcessTLSALPN01Provider
 }
 
 // Implements registration.User
@@ -42,6 +52,12 @@ type AcmeUser struct {
 	Email        string
 	Registration *registration.Resource
 	key          crypto.PrivateKey
+
+	// TermsOfServiceURL and AgreedAt record which CA ToS this account agreed
+	// to, and when, so SaveAccount/LoadAccount can carry that across a
+	// restart alongside the registration itself.
+	TermsOfServiceURL string
+	AgreedAt          time.Time
 }
 
 func (u *AcmeUser) GetEmail() string {
@@ -54,126 +70,298 @@ func (u *AcmeUser) GetPrivateKey() crypto.PrivateKey {
 	return u.key
 }
 
-// Initializes the cert fetcher with information it needs to fetch new certificates in the future.
-// TODO(banaag): per gregable@ comments:
-// Callsite could have some structure like:
-//
-// fetcher := CertFetcher()
-// fetcher.setUser(email, privateKey)
-// fetcher.bindToPort(port)
-func New(email string, eabKid string, eabHmac string, certSignRequest *x509.CertificateRequest,
-	privateKey crypto.PrivateKey, acmeDiscoURL string, httpChallengePort int, httpChallengeWebRoot string,
-	tlsChallengePort int, dnsProvider string, shouldRegister bool) (*CertFetcher, error) {
+// challengeSolver pairs a lego challenge.Provider with the ACME challenge
+// type it was registered to solve, so Register() can wire it into the
+// lego.Client at the right point.
+type challengeSolver struct {
+	kind     challenge.Challenge
+	provider challenge.Provider
+}
+
+// ChallengeSolverFactory lets a caller of AddChallengeSolver plug an
+// arbitrary lego challenge.Provider into the fetcher: one of the built-in
+// HTTP-01/TLS-ALPN-01/DNS-01 providers this package constructs (see
+// NewHTTP01ProviderServer, NewHTTP01Webroot, NewTLSALPN01ProviderServer,
+// NewDNS01Provider below), a lego DNS-01 provider for any of the ~100
+// services lego supports, or a fully custom challenge.Provider
+// implementation (e.g. one backed by the embedding application's own HTTP
+// server).
+type ChallengeSolverFactory interface {
+	// Challenge reports which ACME challenge type the provider returned by
+	// NewProvider solves.
+	Challenge() challenge.Challenge
+	// NewProvider constructs the lego challenge.Provider to register.
+	NewProvider() (challenge.Provider, error)
+}
+
+// NewCertFetcher returns an empty CertFetcher ready to be configured via
+// SetUser, SetCSR, SetACMEDirectory, and AddChallengeSolver, and then
+// finalized with Register.
+func NewCertFetcher() *CertFetcher {
+	return &CertFetcher{}
+}
 
-	acmeUser := AcmeUser{
-		Email: email,
-		key:   privateKey,
+// SetUser configures the ACME account identity the fetcher will register or
+// resolve, keyed by email and the account's private key.
+func (f *CertFetcher) SetUser(email string, privateKey crypto.PrivateKey) {
+	f.AcmeUser = AcmeUser{Email: email, key: privateKey}
+}
+
+// SetCSR sets the certificate signing request that FetchNewCert will submit
+// to the CA.
+func (f *CertFetcher) SetCSR(csr *x509.CertificateRequest) {
+	f.CertSignRequest = csr
+}
+
+// SetACMEDirectory sets the ACME v2 directory URL of the CA to use.
+func (f *CertFetcher) SetACMEDirectory(acmeDiscoURL string) {
+	f.AcmeDiscoveryURL = acmeDiscoURL
+}
+
+// SetAccountStorage configures where Register persists and looks up the
+// ACME account, so that a restart doesn't need to re-resolve or re-register
+// the account with the CA. Without a configured AccountStorage, Register
+// always asks the CA.
+func (f *CertFetcher) SetAccountStorage(storage AccountStorage) {
+	f.accountStorage = storage
+}
+
+// AddChallengeSolver registers a challenge solver constructed by factory.
+// It may be called more than once to register solvers for different
+// challenge types; registering a second solver for a challenge type already
+// registered replaces the first. It must be called before Register, since
+// Register is what builds the lego client every registered solver is wired
+// into.
+func (f *CertFetcher) AddChallengeSolver(factory ChallengeSolverFactory) error {
+	provider, err := factory.NewProvider()
+	if err != nil {
+		return errors.Wrap(err, "constructing challenge solver")
+	}
+	kind := factory.Challenge()
+	for i, s := range f.solvers {
+		if s.kind == kind {
+			f.solvers[i].provider = provider
+			return nil
+		}
 	}
-	config := lego.NewConfig(&acmeUser)
+	f.solvers = append(f.solvers, challengeSolver{kind: kind, provider: provider})
+	return nil
+}
 
-	config.CADirURL = acmeDiscoURL
+// buildLegoClient constructs a lego.Client configured with the fetcher's
+// ACME user and directory URL, with every solver added via
+// AddChallengeSolver wired in.
+func (f *CertFetcher) buildLegoClient() (*lego.Client, error) {
+	config := lego.NewConfig(&f.AcmeUser)
+	config.CADirURL = f.AcmeDiscoveryURL
 	config.Certificate.KeyType = certcrypto.EC256
 
-	client, err := NewLegoClient(config, httpChallengePort, httpChallengeWebRoot, tlsChallengePort, dnsProvider)
+	client, err := lego.NewClient(config)
 	if err != nil {
-		return nil, errors.Wrap(err, "Setting up ACME challenges.")
+		return nil, errors.Wrap(err, "obtaining LEGO client")
 	}
 
-	var reg *registration.Resource
-	if !shouldRegister {
-		acmeUser.Registration = new(registration.Resource)
-	} else if reg, err = client.Registration.ResolveAccountByKey(); err == nil {
-		// Check if we already have an account.
-		acmeUser.Registration = reg
-	} else {
-		// We need to reset the LEGO client after calling Registration.ResolveAccountByKey().
-		client, err = NewLegoClient(config, httpChallengePort, httpChallengeWebRoot, tlsChallengePort, dnsProvider)
-		if err != nil {
-			return nil, errors.Wrap(err, "Setting up ACME challenges.")
+	for _, s := range f.solvers {
+		switch s.kind {
+		case challenge.HTTP01:
+			if err := client.Challenge.SetHTTP01Provider(s.provider); err != nil {
+				return nil, errors.Wrap(err, "setting up HTTP01 challenge provider")
+			}
+		case challenge.TLSALPN01:
+			if err := client.Challenge.SetTLSALPN01Provider(s.provider); err != nil {
+				return nil, errors.Wrap(err, "setting up TLSALPN01 challenge provider")
+			}
+		case challenge.DNS01:
+			if err := client.Challenge.SetDNS01Provider(s.provider, f.dns01Options()...); err != nil {
+				return nil, errors.Wrap(err, "setting up DNS01 challenge provider")
+			}
+		default:
+			return nil, errors.Errorf("unsupported challenge type %q", s.kind)
 		}
+	}
 
-		// TODO(banaag) make sure we present the TOS URL to the user and prompt for confirmation.
-		// The plan is to move this to some separate setup command outside the server which would be
-		// executed one time. Alternatively, we can have a field in the toml file that is documented
-		// to indicate agreement with TOS.
-		if eabKid == "" && eabHmac == "" {
-			reg, err = client.Registration.Register(registration.RegisterOptions{
-				TermsOfServiceAgreed: true})
-		} else {
-			reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
-				TermsOfServiceAgreed: true,
-				Kid:                  eabKid,
-				HmacEncoded:          eabHmac})
-		}
+	return client, nil
+}
 
+// Register finalizes the fetcher: it builds the lego client from the
+// configuration accumulated via the Set.../Add... methods, then resolves or
+// creates the ACME account. eabKid and eabHmac should be left empty unless
+// the CA requires external account binding.
+func (f *CertFetcher) Register(eabKid string, eabHmac string) error {
+	if f.accountStorage != nil {
+		found, err := f.AcmeUser.LoadAccount(f.accountStorage, f.AcmeDiscoveryURL)
 		if err != nil {
-			return nil, errors.Wrap(err, "ACME CA client registration")
+			return errors.Wrap(err, "loading ACME account from storage")
+		}
+		if found {
+			client, err := f.buildLegoClient()
+			if err != nil {
+				return errors.Wrap(err, "setting up ACME challenges")
+			}
+			f.legoClient = client
+			return nil
 		}
-		acmeUser.Registration = reg
 	}
 
-	return &CertFetcher{
-		AcmeDiscoveryURL: acmeDiscoURL,
-		AcmeUser:         acmeUser,
-		legoClient:       client,
-		CertSignRequest:  certSignRequest,
-	}, nil
-}
+	client, err := f.buildLegoClient()
+	if err != nil {
+		return errors.Wrap(err, "setting up ACME challenges")
+	}
 
-// NewLegoClient returns a new Lego ACME Client given the configuration parameters passed in.
-func NewLegoClient(config *lego.Config, httpChallengePort int,
-	httpChallengeWebRoot string, tlsChallengePort int,
-	dnsProvider string) (*lego.Client, error) {
-	// A client facilitates communication with the CA server.
-	client, err := lego.NewClient(config)
+	reg, err := client.Registration.ResolveAccountByKey()
+	if err == nil {
+		// We already have an account.
+		f.AcmeUser.Registration = reg
+		f.legoClient = client
+		if f.accountStorage != nil {
+			if err := f.AcmeUser.SaveAccount(f.accountStorage, f.AcmeDiscoveryURL); err != nil {
+				return errors.Wrap(err, "saving ACME account")
+			}
+		}
+		return nil
+	}
+
+	// We need to reset the LEGO client after calling Registration.ResolveAccountByKey().
+	client, err = f.buildLegoClient()
+	if err != nil {
+		return errors.Wrap(err, "setting up ACME challenges")
+	}
+
+	// TODO(banaag) make sure we present the TOS URL to the user and prompt for confirmation.
+	// The plan is to move this to some separate setup command outside the server which would be
+	// executed one time. Alternatively, we can have a field in the toml file that is documented
+	// to indicate agreement with TOS.
+	if eabKid == "" && eabHmac == "" {
+		reg, err = client.Registration.Register(registration.RegisterOptions{
+			TermsOfServiceAgreed: true})
+	} else {
+		reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+			TermsOfServiceAgreed: true,
+			Kid:                  eabKid,
+			HmacEncoded:          eabHmac})
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "Obtaining LEGO client.")
+		return errors.Wrap(err, "ACME CA client registration")
 	}
 
-	// We specify an http port of `httpChallengePort`
-	// because we aren't running as root and can't bind a listener to port 80 and 443
-	// (used later when we attempt to pass challenges). Keep in mind that you still
-	// need to proxy challenge traffic to port `acmeChallengePort`.
+	f.AcmeUser.Registration = reg
+	f.AcmeUser.TermsOfServiceURL = client.GetToSURL()
+	f.AcmeUser.AgreedAt = time.Now()
+	f.legoClient = client
+	if f.accountStorage != nil {
+		if err := f.AcmeUser.SaveAccount(f.accountStorage, f.AcmeDiscoveryURL); err != nil {
+			return errors.Wrap(err, "saving ACME account")
+		}
+	}
+	return nil
+}
+
+// New initializes a CertFetcher with the information it needs to fetch new
+// certificates in the future. It is a thin backward-compatible wrapper
+// around NewCertFetcher and the builder methods below; new callers,
+// especially those embedding this package as a library, should prefer
+// calling NewCertFetcher directly so they can supply their own
+// ChallengeSolverFactory (e.g. to reuse an HTTP server they already run
+// instead of binding a second port).
+func New(email string, eabKid string, eabHmac string, certSignRequest *x509.CertificateRequest,
+	privateKey crypto.PrivateKey, acmeDiscoURL string, httpChallengePort int, httpChallengeWebRoot string,
+	tlsChallengePort int, dnsProvider string, shouldRegister bool) (*CertFetcher, error) {
+
+	fetcher := NewCertFetcher()
+	fetcher.SetUser(email, privateKey)
+	fetcher.SetCSR(certSignRequest)
+	fetcher.SetACMEDirectory(acmeDiscoURL)
+
 	if httpChallengePort != 0 {
-		err := client.Challenge.SetHTTP01Provider(
-			http01.NewProviderServer("", strconv.Itoa(httpChallengePort)))
-		if err != nil {
-			return nil, errors.Wrap(err, "Setting up HTTP01 challenge provider.")
+		if err := fetcher.AddChallengeSolver(NewHTTP01ProviderServer("", httpChallengePort)); err != nil {
+			return nil, errors.Wrap(err, "setting up ACME challenges")
 		}
 	}
 	if httpChallengeWebRoot != "" {
-		httpProvider, err := webroot.NewHTTPProvider(httpChallengeWebRoot)
-		if err != nil {
-			return nil, errors.Wrap(err, "Getting HTTP01 challenge provider.")
-		}
-		err = client.Challenge.SetHTTP01Provider(httpProvider)
-		if err != nil {
-			return nil, errors.Wrap(err, "Setting up HTTP01 challenge provider.")
+		if err := fetcher.AddChallengeSolver(NewHTTP01Webroot(httpChallengeWebRoot)); err != nil {
+			return nil, errors.Wrap(err, "setting up ACME challenges")
 		}
 	}
-
 	if tlsChallengePort != 0 {
-		err := client.Challenge.SetTLSALPN01Provider(tlsalpn01.NewProviderServer("", strconv.Itoa(tlsChallengePort)))
-		if err != nil {
-			return nil, errors.Wrap(err, "Setting up TLSALPN01 challenge provider.")
+		if err := fetcher.AddChallengeSolver(NewTLSALPN01ProviderServer("", tlsChallengePort)); err != nil {
+			return nil, errors.Wrap(err, "setting up ACME challenges")
 		}
 	}
-
 	if dnsProvider != "" {
-		provider, err := DNSProvider(dnsProvider)
-		if err != nil {
-			return nil, errors.Wrap(err, "Getting DNS01 challenge provider.")
+		if err := fetcher.AddChallengeSolver(NewDNS01Provider(dnsProvider)); err != nil {
+			return nil, errors.Wrap(err, "setting up ACME challenges")
 		}
-		err = client.Challenge.SetDNS01Provider(provider)
+	}
+
+	if !shouldRegister {
+		client, err := fetcher.buildLegoClient()
 		if err != nil {
-			return nil, errors.Wrap(err, "Setting up DNS01 challenge provider.")
+			return nil, errors.Wrap(err, "setting up ACME challenges")
 		}
+		fetcher.AcmeUser.Registration = new(registration.Resource)
+		fetcher.legoClient = client
+		return fetcher, nil
 	}
 
-	return client, nil
+	if err := fetcher.Register(eabKid, eabHmac); err != nil {
+		return nil, err
+	}
+	return fetcher, nil
+}
+
+// dns01Options translates the fetcher's FetchOptions into the
+// dns01.ChallengeOption values lego's SetDNS01Provider expects.
+func (f *CertFetcher) dns01Options() []dns01.ChallengeOption {
+	if f.fetchOptions == nil {
+		return nil
+	}
+	var opts []dns01.ChallengeOption
+	if len(f.fetchOptions.PreCheckNameservers) > 0 {
+		opts = append(opts, dns01.AddRecursiveNameservers(f.fetchOptions.PreCheckNameservers))
+	}
+	if f.fetchOptions.DisableCompletePropagationRequirement {
+		opts = append(opts, dns01.DisableCompletePropagationRequirement())
+	}
+	if f.fetchOptions.PropagationTimeout > 0 {
+		opts = append(opts, dns01.AddDNSTimeout(f.fetchOptions.PropagationTimeout))
+	}
+	return opts
 }
 
 func (f *CertFetcher) FetchNewCert() ([]*x509.Certificate, error) {
+	maxAttempts := 1
+	backoff := time.Duration(0)
+	if f.fetchOptions != nil && f.fetchOptions.MaxAttempts > 1 {
+		maxAttempts = f.fetchOptions.MaxAttempts
+		backoff = f.fetchOptions.InitialBackoff
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		cert, err := f.fetchNewCertOnce()
+		if err == nil {
+			return cert, nil
+		}
+
+		lastErr = classifyFetchError(err)
+		if attempt == maxAttempts {
+			break
+		}
+
+		wait := backoff
+		if rateLimited, ok := lastErr.(*ErrRateLimited); ok && rateLimited.RetryAfter > 0 {
+			wait = rateLimited.RetryAfter
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		backoff *= 2
+	}
+
+	return nil, lastErr
+}
+
+func (f *CertFetcher) fetchNewCertOnce() ([]*x509.Certificate, error) {
 	csr := certificate.ObtainForCSRRequest{
 		CSR:    f.CertSignRequest,
 		Bundle: true,
@@ -198,5 +386,16 @@ func (f *CertFetcher) FetchNewCert() ([]*x509.Certificate, error) {
 		return nil, err
 	}
 
+	if len(cert) > 0 {
+		// Recording is best-effort bookkeeping for ListManagedCertificates,
+		// not part of obtaining the certificate: a local storage hiccup here
+		// (e.g. a full disk) must not discard a certificate the CA already
+		// issued, nor feed FetchNewCert's retry loop a reason to burn CA
+		// rate-limit quota re-ordering one that's sitting right here.
+		if err := f.recordCertificate(cert[0]); err != nil {
+			log.Printf("certfetcher: recording fetched certificate: %v", err)
+		}
+	}
+
 	return cert, err
 }
@@ -0,0 +1,269 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-acme/lego/v4/registration"
+)
+
+// fakeACMEServer is a minimal stand-in for an ACME v2 CA: just enough of
+// the directory, newNonce, and newAccount endpoints to drive
+// lego.NewClient and client.Registration through Register's branches
+// without a real CA.
+type fakeACMEServer struct {
+	*httptest.Server
+	registered bool
+	// allowNewAccount lets a test assert a code path never contacts the CA
+	// for account resolution/creation: when false, /new-acct 404s.
+	allowNewAccount bool
+}
+
+func newFakeACMEServer(allowNewAccount bool) *fakeACMEServer {
+	s := &fakeACMEServer{allowNewAccount: allowNewAccount}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", s.handleDirectory)
+	mux.HandleFunc("/new-nonce", s.handleNewNonce)
+	mux.HandleFunc("/new-acct", s.handleNewAccount)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *fakeACMEServer) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "testnonce")
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{
+		"newNonce": %q,
+		"newAccount": %q,
+		"newOrder": %q,
+		"revokeCert": %q,
+		"keyChange": %q,
+		"meta": {"termsOfService": %q}
+	}`, s.URL+"/new-nonce", s.URL+"/new-acct", s.URL+"/new-order", s.URL+"/revoke-cert", s.URL+"/key-change", s.URL+"/tos")
+}
+
+func (s *fakeACMEServer) handleNewNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "testnonce")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleNewAccount responds to both ResolveAccountByKey (a JWS payload with
+// "onlyReturnExisting":true) and a fresh Register call, tracking whether an
+// account has been created so the former can succeed or fail accordingly.
+func (s *fakeACMEServer) handleNewAccount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "testnonce")
+	if !s.allowNewAccount {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	var envelope struct {
+		Payload string `json:"payload"`
+	}
+	_ = json.Unmarshal(body, &envelope)
+	payload, _ := base64.RawURLEncoding.DecodeString(envelope.Payload)
+	onlyReturnExisting := strings.Contains(string(payload), `"onlyReturnExisting":true`)
+
+	w.Header().Set("Location", s.URL+"/acct/1")
+	w.Header().Set("Content-Type", "application/json")
+
+	if onlyReturnExisting {
+		if !s.registered {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"type":"urn:ietf:params:acme:error:accountDoesNotExist","detail":"no such account"}`)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"status":"valid"}`)
+		return
+	}
+
+	s.registered = true
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, `{"status":"valid"}`)
+}
+
+func TestCertFetcherBuilderSetters(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := &x509.CertificateRequest{}
+
+	f := NewCertFetcher()
+	f.SetUser("ops@example.com", key)
+	f.SetCSR(csr)
+	f.SetACMEDirectory("https://ca.example/directory")
+
+	if f.AcmeUser.Email != "ops@example.com" {
+		t.Errorf("Email = %q, want ops@example.com", f.AcmeUser.Email)
+	}
+	if f.AcmeUser.GetPrivateKey() != crypto.PrivateKey(key) {
+		t.Error("private key not set by SetUser")
+	}
+	if f.CertSignRequest != csr {
+		t.Error("CSR not set by SetCSR")
+	}
+	if f.AcmeDiscoveryURL != "https://ca.example/directory" {
+		t.Errorf("AcmeDiscoveryURL = %q, want https://ca.example/directory", f.AcmeDiscoveryURL)
+	}
+}
+
+func TestAddChallengeSolverReplacesSameKind(t *testing.T) {
+	f := NewCertFetcher()
+	if err := f.AddChallengeSolver(NewHTTP01Webroot(t.TempDir())); err != nil {
+		t.Fatalf("first AddChallengeSolver: %v", err)
+	}
+	if err := f.AddChallengeSolver(NewHTTP01Webroot(t.TempDir())); err != nil {
+		t.Fatalf("second AddChallengeSolver: %v", err)
+	}
+	if len(f.solvers) != 1 {
+		t.Fatalf("expected 1 solver after re-adding the same challenge kind, got %d", len(f.solvers))
+	}
+}
+
+func TestRegisterLoadsFromAccountStorageWithoutContactingCA(t *testing.T) {
+	// allowNewAccount is false: if Register mistakenly falls through to
+	// resolving or registering through the CA instead of using the stored
+	// account, /new-acct 404s and this test fails.
+	server := newFakeACMEServer(false)
+	defer server.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := &FileAccountStorage{Dir: t.TempDir()}
+	seed := &AcmeUser{Email: "ops@example.com", key: key, Registration: &registration.Resource{URI: server.URL + "/acct/1"}}
+	if err := seed.SaveAccount(storage, server.URL+"/directory"); err != nil {
+		t.Fatalf("seeding account storage: %v", err)
+	}
+
+	f := NewCertFetcher()
+	f.SetUser("ops@example.com", key)
+	f.SetACMEDirectory(server.URL + "/directory")
+	f.SetAccountStorage(storage)
+
+	if err := f.Register("", ""); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if f.AcmeUser.Registration == nil || f.AcmeUser.Registration.URI != seed.Registration.URI {
+		t.Errorf("Registration = %+v, want the one loaded from storage", f.AcmeUser.Registration)
+	}
+}
+
+func TestRegisterResolvesExistingAccountByKey(t *testing.T) {
+	server := newFakeACMEServer(true)
+	defer server.Close()
+	server.registered = true // the account already exists at the CA
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewCertFetcher()
+	f.SetUser("ops@example.com", key)
+	f.SetACMEDirectory(server.URL + "/directory")
+
+	if err := f.Register("", ""); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if f.AcmeUser.Registration == nil {
+		t.Fatal("expected ResolveAccountByKey to populate Registration")
+	}
+}
+
+func TestRegisterCreatesFreshAccount(t *testing.T) {
+	server := newFakeACMEServer(true)
+	defer server.Close()
+	// server.registered starts false, so ResolveAccountByKey fails and
+	// Register falls through to creating a fresh account.
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewCertFetcher()
+	f.SetUser("ops@example.com", key)
+	f.SetACMEDirectory(server.URL + "/directory")
+
+	if err := f.Register("", ""); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if f.AcmeUser.Registration == nil {
+		t.Fatal("expected a fresh registration")
+	}
+	if f.AcmeUser.TermsOfServiceURL == "" {
+		t.Error("expected TermsOfServiceURL to be recorded for a fresh registration")
+	}
+}
+
+func TestNewRegistersByDefault(t *testing.T) {
+	server := newFakeACMEServer(true)
+	defer server.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := &x509.CertificateRequest{}
+
+	fetcher, err := New("ops@example.com", "", "", csr, key, server.URL+"/directory", 0, "", 0, "", true)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if fetcher.AcmeUser.Registration == nil {
+		t.Error("expected New to have registered an account")
+	}
+}
+
+func TestNewSkipsRegistrationWhenNotRequested(t *testing.T) {
+	// allowNewAccount is false: New must not contact the CA for account
+	// resolution/creation when shouldRegister is false.
+	server := newFakeACMEServer(false)
+	defer server.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := &x509.CertificateRequest{}
+
+	fetcher, err := New("ops@example.com", "", "", csr, key, server.URL+"/directory", 0, "", 0, "", false)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if fetcher.AcmeUser.Registration == nil {
+		t.Fatal("expected a placeholder registration resource")
+	}
+}
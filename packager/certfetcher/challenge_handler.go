@@ -0,0 +1,169 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/pkg/errors"
+)
+
+// manualChallengeSolverFactory adapts an already-constructed
+// challenge.Provider (one the fetcher built itself, e.g. for
+// ChallengeHandler, or one a caller hands to SetHTTP01Manual) into a
+// ChallengeSolverFactory so it can go through the same AddChallengeSolver
+// path as every other solver.
+type manualChallengeSolverFactory struct {
+	kind     challenge.Challenge
+	provider challenge.Provider
+}
+
+func (m manualChallengeSolverFactory) Challenge() challenge.Challenge { return m.kind }
+func (m manualChallengeSolverFactory) NewProvider() (challenge.Provider, error) {
+	return m.provider, nil
+}
+
+// SetHTTP01Manual registers provider as the fetcher's HTTP-01 solver. Unlike
+// ChallengeHandler, this is for a caller supplying their own in-process
+// implementation (e.g. one that multiplexes onto an HTTP server they
+// already run in some other way than ChallengeHandler's default handler).
+func (f *CertFetcher) SetHTTP01Manual(provider challenge.Provider) error {
+	return f.AddChallengeSolver(manualChallengeSolverFactory{challenge.HTTP01, provider})
+}
+
+// inProcessHTTP01Provider answers HTTP-01 challenges by holding key
+// authorizations in memory and serving them as an http.Handler, so the
+// packager's own mux can respond to the CA without binding a second port or
+// sharing a webroot directory with it.
+type inProcessHTTP01Provider struct {
+	mu     sync.Mutex
+	tokens map[string]string // token -> key authorization
+}
+
+func (p *inProcessHTTP01Provider) Present(domain, token, keyAuth string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tokens == nil {
+		p.tokens = make(map[string]string)
+	}
+	p.tokens[token] = keyAuth
+	return nil
+}
+
+func (p *inProcessHTTP01Provider) CleanUp(domain, token, keyAuth string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.tokens, token)
+	return nil
+}
+
+func (p *inProcessHTTP01Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, http01.ChallengePath(""))
+	p.mu.Lock()
+	keyAuth, ok := p.tokens[token]
+	p.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+}
+
+// ChallengeHandler returns an http.Handler implementing the
+// /.well-known/acme-challenge/{token} HTTP-01 responder in-process, and
+// registers it as the fetcher's HTTP-01 solver -- replacing any solver
+// already registered for HTTP-01, the same way a second call to
+// AddChallengeSolver for that challenge type would. It must be called
+// before Register, since Register is what builds the lego client the
+// registered solver is wired into; calling it afterward has no effect on an
+// already-built client. Mount the returned handler on the packager's
+// existing mux; no extra port or shared filesystem is needed, unlike
+// NewHTTP01ProviderServer or NewHTTP01Webroot.
+func (f *CertFetcher) ChallengeHandler() http.Handler {
+	if f.http01Provider == nil {
+		f.http01Provider = &inProcessHTTP01Provider{}
+	}
+	// NewProvider on manualChallengeSolverFactory never errors.
+	_ = f.AddChallengeSolver(manualChallengeSolverFactory{challenge.HTTP01, f.http01Provider})
+	return f.http01Provider
+}
+
+// inProcessTLSALPN01Provider answers TLS-ALPN-01 challenges by holding
+// self-signed challenge certificates in memory, served through the
+// *tls.Config returned by TLSALPNHandler's GetCertificate callback.
+type inProcessTLSALPN01Provider struct {
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate // domain -> challenge certificate
+}
+
+func (p *inProcessTLSALPN01Provider) Present(domain, token, keyAuth string) error {
+	cert, err := tlsalpn01.ChallengeCert(domain, keyAuth)
+	if err != nil {
+		return errors.Wrap(err, "building TLS-ALPN-01 challenge certificate")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.certs == nil {
+		p.certs = make(map[string]*tls.Certificate)
+	}
+	p.certs[domain] = &cert
+	return nil
+}
+
+func (p *inProcessTLSALPN01Provider) CleanUp(domain, token, keyAuth string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.certs, domain)
+	return nil
+}
+
+func (p *inProcessTLSALPN01Provider) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.certs[hello.ServerName], nil
+}
+
+// TLSALPNHandler returns a *tls.Config snippet implementing the
+// TLS-ALPN-01 responder in-process, and registers it as the fetcher's
+// TLS-ALPN-01 solver -- replacing any solver already registered for
+// TLS-ALPN-01, the same way a second call to AddChallengeSolver for that
+// challenge type would. It must be called before Register, since Register
+// is what builds the lego client the registered solver is wired into;
+// calling it afterward has no effect on an already-built client. Merge its
+// NextProtos and GetCertificate into the config of a listener terminating
+// TLS in-process, so ALPN challenges can be multiplexed onto the packager's
+// existing 443 listener instead of requiring NewTLSALPN01ProviderServer's
+// separate port. GetCertificate returns nil, nil for any ServerName it
+// doesn't recognize as an in-flight challenge; callers should fall back to
+// their own certificate in that case.
+func (f *CertFetcher) TLSALPNHandler() *tls.Config {
+	if f.tlsALPN01Provider == nil {
+		f.tlsALPN01Provider = &inProcessTLSALPN01Provider{}
+	}
+	// NewProvider on manualChallengeSolverFactory never errors.
+	_ = f.AddChallengeSolver(manualChallengeSolverFactory{challenge.TLSALPN01, f.tlsALPN01Provider})
+	return &tls.Config{
+		NextProtos:     []string{tlsalpn01.ACMETLS1Protocol},
+		GetCertificate: f.tlsALPN01Provider.getCertificate,
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"testing"
+
+	"github.com/go-acme/lego/v4/challenge"
+)
+
+func TestChallengeHandlerReplacesExistingHTTP01Solver(t *testing.T) {
+	f := NewCertFetcher()
+	if err := f.AddChallengeSolver(NewHTTP01Webroot(t.TempDir())); err != nil {
+		t.Fatalf("AddChallengeSolver: %v", err)
+	}
+
+	f.ChallengeHandler()
+
+	if len(f.solvers) != 1 {
+		t.Fatalf("expected exactly 1 HTTP01 solver after ChallengeHandler, got %d", len(f.solvers))
+	}
+	if f.solvers[0].kind != challenge.HTTP01 {
+		t.Errorf("solver kind = %v, want HTTP01", f.solvers[0].kind)
+	}
+	if f.solvers[0].provider != f.http01Provider {
+		t.Error("expected ChallengeHandler's in-process provider to replace the webroot solver")
+	}
+}
+
+func TestAddChallengeSolverReplacesChallengeHandler(t *testing.T) {
+	f := NewCertFetcher()
+	f.ChallengeHandler()
+
+	if err := f.AddChallengeSolver(NewHTTP01Webroot(t.TempDir())); err != nil {
+		t.Fatalf("AddChallengeSolver: %v", err)
+	}
+
+	if len(f.solvers) != 1 {
+		t.Fatalf("expected exactly 1 HTTP01 solver after re-adding, got %d", len(f.solvers))
+	}
+	if f.solvers[0].provider == f.http01Provider {
+		t.Error("expected the webroot solver to replace ChallengeHandler's in-process provider")
+	}
+}
+
+func TestTLSALPNHandlerRegistersSingleSolver(t *testing.T) {
+	f := NewCertFetcher()
+	f.TLSALPNHandler()
+	f.TLSALPNHandler()
+
+	if len(f.solvers) != 1 {
+		t.Fatalf("expected exactly 1 TLSALPN01 solver, got %d", len(f.solvers))
+	}
+	if f.solvers[0].kind != challenge.TLSALPN01 {
+		t.Errorf("solver kind = %v, want TLSALPN01", f.solvers[0].kind)
+	}
+}
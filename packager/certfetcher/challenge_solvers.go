@@ -0,0 +1,121 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"strconv"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/go-acme/lego/v4/providers/http/webroot"
+	"github.com/pkg/errors"
+)
+
+// The ChallengeSolverFactory implementations below are the ones New() wires
+// up from its legacy, position-based parameters. Callers building a
+// CertFetcher directly via NewCertFetcher can use these too, or supply their
+// own to plug in any lego challenge.Provider (e.g. one of lego's ~100 DNS-01
+// providers, or a challenge.Provider backed by a server the caller already
+// runs).
+
+type http01ProviderServerFactory struct {
+	iface string
+	port  int
+}
+
+// NewHTTP01ProviderServer returns a ChallengeSolverFactory that binds its
+// own listener on iface:port to answer HTTP-01 challenges. Pass an empty
+// iface to listen on all interfaces.
+func NewHTTP01ProviderServer(iface string, port int) ChallengeSolverFactory {
+	return &http01ProviderServerFactory{iface: iface, port: port}
+}
+
+func (f *http01ProviderServerFactory) Challenge() challenge.Challenge {
+	return challenge.HTTP01
+}
+
+// We specify an http port of `f.port` because we aren't running as root and
+// can't bind a listener to port 80 and 443 (used later when we attempt to
+// pass challenges). Keep in mind that you still need to proxy challenge
+// traffic to port `f.port`.
+func (f *http01ProviderServerFactory) NewProvider() (challenge.Provider, error) {
+	return http01.NewProviderServer(f.iface, strconv.Itoa(f.port)), nil
+}
+
+type http01WebrootFactory struct {
+	path string
+}
+
+// NewHTTP01Webroot returns a ChallengeSolverFactory that answers HTTP-01
+// challenges by writing tokens into path, expecting something else (e.g. an
+// already-running web server) to serve them.
+func NewHTTP01Webroot(path string) ChallengeSolverFactory {
+	return &http01WebrootFactory{path: path}
+}
+
+func (f *http01WebrootFactory) Challenge() challenge.Challenge {
+	return challenge.HTTP01
+}
+
+func (f *http01WebrootFactory) NewProvider() (challenge.Provider, error) {
+	provider, err := webroot.NewHTTPProvider(f.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting HTTP01 challenge provider")
+	}
+	return provider, nil
+}
+
+type tlsALPN01ProviderServerFactory struct {
+	iface string
+	port  int
+}
+
+// NewTLSALPN01ProviderServer returns a ChallengeSolverFactory that binds its
+// own listener on iface:port to answer TLS-ALPN-01 challenges.
+func NewTLSALPN01ProviderServer(iface string, port int) ChallengeSolverFactory {
+	return &tlsALPN01ProviderServerFactory{iface: iface, port: port}
+}
+
+func (f *tlsALPN01ProviderServerFactory) Challenge() challenge.Challenge {
+	return challenge.TLSALPN01
+}
+
+func (f *tlsALPN01ProviderServerFactory) NewProvider() (challenge.Provider, error) {
+	return tlsalpn01.NewProviderServer(f.iface, strconv.Itoa(f.port)), nil
+}
+
+type dns01ProviderFactory struct {
+	name string
+}
+
+// NewDNS01Provider returns a ChallengeSolverFactory that answers DNS-01
+// challenges using the named lego DNS provider (see DNSProvider), configured
+// from that provider's usual environment variables.
+func NewDNS01Provider(name string) ChallengeSolverFactory {
+	return &dns01ProviderFactory{name: name}
+}
+
+func (f *dns01ProviderFactory) Challenge() challenge.Challenge {
+	return challenge.DNS01
+}
+
+func (f *dns01ProviderFactory) NewProvider() (challenge.Provider, error) {
+	provider, err := DNSProvider(f.name)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting DNS01 challenge provider")
+	}
+	return provider, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+)
+
+// FetchOptions controls how FetchNewCert tolerates transient failures: slow
+// DNS-01 propagation, a flaky nameserver, or the CA asking us to slow down.
+// The zero value means a single attempt with lego's built-in defaults;
+// DefaultFetchOptions is a starting point with one retry enabled.
+type FetchOptions struct {
+	// PropagationTimeout is passed to lego as its DNS query timeout (via
+	// dns01.AddDNSTimeout): it bounds each DNS query made while checking
+	// DNS-01 propagation. It does not bound how long lego waits for the
+	// record to propagate; that wait is the DNS provider's own timeout.
+	PropagationTimeout time.Duration
+	// PreCheckNameservers, if set, are queried directly (bypassing the
+	// system resolver) to decide whether a DNS-01 record has propagated,
+	// via dns01.AddRecursiveNameservers.
+	PreCheckNameservers []string
+	// DisableCompletePropagationRequirement, if true, accepts a DNS-01
+	// record as propagated once any nameserver returns it, rather than
+	// requiring all of them to agree.
+	DisableCompletePropagationRequirement bool
+	// MaxAttempts is the total number of times FetchNewCert attempts the
+	// whole ACME order; any failure before the last attempt is retried.
+	// Values <= 1 disable retrying.
+	MaxAttempts int
+	// InitialBackoff is the delay before the second attempt; each
+	// subsequent attempt doubles it.
+	InitialBackoff time.Duration
+}
+
+// DefaultFetchOptions returns reasonable defaults: a 60 second DNS query
+// timeout (see PropagationTimeout), one retry after a five second backoff,
+// and no DNS precheck override.
+func DefaultFetchOptions() FetchOptions {
+	return FetchOptions{
+		PropagationTimeout: 60 * time.Second,
+		MaxAttempts:        2,
+		InitialBackoff:     5 * time.Second,
+	}
+}
+
+// SetFetchOptions configures retry, backoff, and DNS-01 precheck behavior
+// for FetchNewCert. Without a call to SetFetchOptions, FetchNewCert behaves
+// as before: a single attempt with lego's built-in defaults.
+func (f *CertFetcher) SetFetchOptions(opts FetchOptions) {
+	f.fetchOptions = &opts
+}
+
+// ErrChallengeFailed wraps an error returned while the CA was validating an
+// ACME challenge (as opposed to, say, a network error talking to the CA
+// itself), so callers can tell a misconfigured challenge solver apart from a
+// transient or rate-limit failure.
+type ErrChallengeFailed struct {
+	Err error
+}
+
+func (e *ErrChallengeFailed) Error() string {
+	return "ACME challenge failed: " + e.Err.Error()
+}
+
+func (e *ErrChallengeFailed) Unwrap() error {
+	return e.Err
+}
+
+// ErrRateLimited wraps an error the CA returned as
+// urn:ietf:params:acme:error:rateLimited, along with how long the CA asked
+// us to wait (via the Retry-After header) before trying again, if it said.
+type ErrRateLimited struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *ErrRateLimited) Error() string {
+	return "ACME rate limited: " + e.Err.Error()
+}
+
+func (e *ErrRateLimited) Unwrap() error {
+	return e.Err
+}
+
+const acmeProblemPrefix = "urn:ietf:params:acme:error:"
+
+const rateLimitedProblemType = acmeProblemPrefix + "rateLimited"
+
+// challengeProblemTypes are the RFC 8555 §6.7 problem types the CA returns
+// specifically because it couldn't validate a challenge -- as opposed to,
+// say, a malformed request, an internal CA error, or a rate limit -- so
+// wrapping them in ErrChallengeFailed actually means "the challenge solver
+// didn't work," not "something, somewhere, went wrong."
+var challengeProblemTypes = map[string]bool{
+	acmeProblemPrefix + "incorrectResponse": true,
+	acmeProblemPrefix + "caa":               true,
+	acmeProblemPrefix + "dns":               true,
+	acmeProblemPrefix + "tls":               true,
+	acmeProblemPrefix + "unauthorized":      true,
+	acmeProblemPrefix + "connection":        true,
+}
+
+// classifyFetchError recognizes the ACME problem types FetchNewCert reports
+// as structured errors (its retry loop only acts on ErrRateLimited's
+// RetryAfter), wrapping err into ErrRateLimited or
+// ErrChallengeFailed when it can. Errors it doesn't recognize, including
+// other ACME problem types like badCSR or serverInternal, are returned
+// unchanged.
+func classifyFetchError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var problem *acme.ProblemDetails
+	if errors.As(err, &problem) {
+		if problem.Type == rateLimitedProblemType {
+			var retryAfter time.Duration
+			if problem.RetryAfter > 0 {
+				retryAfter = time.Duration(problem.RetryAfter) * time.Second
+			}
+			return &ErrRateLimited{Err: err, RetryAfter: retryAfter}
+		}
+		if challengeProblemTypes[problem.Type] {
+			return &ErrChallengeFailed{Err: err}
+		}
+	}
+
+	return err
+}
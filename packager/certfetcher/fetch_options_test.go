@@ -0,0 +1,91 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+)
+
+func TestClassifyFetchError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want interface{} // nil means "returned unchanged"
+	}{
+		{
+			name: "rate limited with retry-after",
+			err:  &acme.ProblemDetails{Type: "urn:ietf:params:acme:error:rateLimited", RetryAfter: 30},
+			want: &ErrRateLimited{RetryAfter: 30 * time.Second},
+		},
+		{
+			name: "incorrect response is a challenge failure",
+			err:  &acme.ProblemDetails{Type: "urn:ietf:params:acme:error:incorrectResponse"},
+			want: &ErrChallengeFailed{},
+		},
+		{
+			name: "unauthorized is a challenge failure",
+			err:  &acme.ProblemDetails{Type: "urn:ietf:params:acme:error:unauthorized"},
+			want: &ErrChallengeFailed{},
+		},
+		{
+			name: "malformed is not a challenge failure",
+			err:  &acme.ProblemDetails{Type: "urn:ietf:params:acme:error:malformed"},
+			want: nil,
+		},
+		{
+			name: "serverInternal is not a challenge failure",
+			err:  &acme.ProblemDetails{Type: "urn:ietf:params:acme:error:serverInternal"},
+			want: nil,
+		},
+		{
+			name: "badCSR is not a challenge failure",
+			err:  &acme.ProblemDetails{Type: "urn:ietf:params:acme:error:badCSR"},
+			want: nil,
+		},
+		{
+			name: "plain error is returned unchanged",
+			err:  errors.New("network error talking to the CA"),
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyFetchError(tt.err)
+			switch want := tt.want.(type) {
+			case nil:
+				if got != tt.err {
+					t.Errorf("classifyFetchError(%v) = %v, want unchanged", tt.err, got)
+				}
+			case *ErrRateLimited:
+				rl, ok := got.(*ErrRateLimited)
+				if !ok {
+					t.Fatalf("classifyFetchError(%v) = %T, want *ErrRateLimited", tt.err, got)
+				}
+				if rl.RetryAfter != want.RetryAfter {
+					t.Errorf("RetryAfter = %v, want %v", rl.RetryAfter, want.RetryAfter)
+				}
+			case *ErrChallengeFailed:
+				if _, ok := got.(*ErrChallengeFailed); !ok {
+					t.Fatalf("classifyFetchError(%v) = %T, want *ErrChallengeFailed", tt.err, got)
+				}
+			}
+		})
+	}
+}
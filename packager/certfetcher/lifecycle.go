@@ -0,0 +1,147 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Revoke revokes cert with the CA, reporting reason as one of the CRL
+// reason codes from RFC 5280 section 5.3.1 (e.g. 1 for keyCompromise, 5 for
+// cessationOfOperation when decommissioning).
+func (f *CertFetcher) Revoke(cert *x509.Certificate, reason uint32) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := f.legoClient.Certificate.RevokeWithReason(certPEM, &reason); err != nil {
+		return errors.Wrap(err, "revoking certificate")
+	}
+	return nil
+}
+
+// ArchiveRevoked moves a revoked certificate's PEM file (and, if present,
+// its sibling OCSP response) into a timestamped subdirectory of dir, rather
+// than deleting it, so operators retain a record of what was revoked and
+// when.
+func ArchiveRevoked(dir string, certPath string, ocspPath string) error {
+	archiveDir := filepath.Join(dir, time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.MkdirAll(archiveDir, 0700); err != nil {
+		return errors.Wrap(err, "creating archive directory")
+	}
+
+	if err := os.Rename(certPath, filepath.Join(archiveDir, filepath.Base(certPath))); err != nil {
+		return errors.Wrap(err, "archiving revoked certificate")
+	}
+
+	if ocspPath == "" {
+		return nil
+	}
+	if _, err := os.Stat(ocspPath); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.Rename(ocspPath, filepath.Join(archiveDir, filepath.Base(ocspPath))); err != nil {
+		return errors.Wrap(err, "archiving OCSP response")
+	}
+	return nil
+}
+
+// managedCertificateStore is implemented by AccountStorage backends that can
+// also persist and enumerate the certificates CertFetcher has previously
+// obtained through them. FileAccountStorage implements it by writing and
+// listing PEM files next to the account it manages.
+type managedCertificateStore interface {
+	SaveCertificate(serialNumber string, certPEM []byte) error
+	ListCertificates() ([]string, error)
+}
+
+// certificatesDir is where FileAccountStorage keeps obtained certificates,
+// separate from the per-account directories Load/Save use.
+func (s *FileAccountStorage) certificatesDir() string {
+	return filepath.Join(s.Dir, "certificates")
+}
+
+// SaveCertificate writes certPEM under this storage's certificates
+// directory, named by the certificate's serial number, so it later shows up
+// in ListCertificates. recordCertificate calls this after every successful
+// fetch when the fetcher has an AccountStorage configured.
+func (s *FileAccountStorage) SaveCertificate(serialNumber string, certPEM []byte) error {
+	dir := s.certificatesDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "creating certificates directory")
+	}
+	path := filepath.Join(dir, serialNumber+".pem")
+	if err := os.WriteFile(path, certPEM, 0600); err != nil {
+		return errors.Wrap(err, "writing certificate")
+	}
+	return nil
+}
+
+// ListCertificates lists the PEM files under this FileAccountStorage's
+// certificates directory. It does not descend into per-account
+// account.json/keys directories.
+func (s *FileAccountStorage) ListCertificates() ([]string, error) {
+	certsDir := s.certificatesDir()
+	entries, err := os.ReadDir(certsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "listing managed certificates")
+	}
+
+	var certs []string
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".pem" {
+			continue
+		}
+		certs = append(certs, filepath.Join(certsDir, entry.Name()))
+	}
+	return certs, nil
+}
+
+// recordCertificate persists cert to f's AccountStorage, if any and if it
+// supports it, so that a later ListManagedCertificates call can find it. A
+// fetcher with no AccountStorage configured, or one whose AccountStorage
+// doesn't implement managedCertificateStore, simply skips recording.
+func (f *CertFetcher) recordCertificate(cert *x509.Certificate) error {
+	if f.accountStorage == nil {
+		return nil
+	}
+	store, ok := f.accountStorage.(managedCertificateStore)
+	if !ok {
+		return nil
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return store.SaveCertificate(cert.SerialNumber.String(), certPEM)
+}
+
+// ListManagedCertificates enumerates the certificates this fetcher has
+// previously obtained, as recorded in its configured AccountStorage. It
+// returns an error if the fetcher has no AccountStorage configured, or if
+// that AccountStorage doesn't support listing certificates.
+func (f *CertFetcher) ListManagedCertificates() ([]string, error) {
+	if f.accountStorage == nil {
+		return nil, errors.New("ListManagedCertificates requires an AccountStorage; call SetAccountStorage first")
+	}
+	store, ok := f.accountStorage.(managedCertificateStore)
+	if !ok {
+		return nil, errors.Errorf("%T does not support listing managed certificates", f.accountStorage)
+	}
+	return store.ListCertificates()
+}
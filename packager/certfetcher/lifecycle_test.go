@@ -0,0 +1,81 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certfetcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCertificate(t *testing.T, serial int64) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestRecordCertificateAndListManagedCertificates(t *testing.T) {
+	dir := t.TempDir()
+	storage := &FileAccountStorage{Dir: dir}
+	fetcher := NewCertFetcher()
+	fetcher.SetAccountStorage(storage)
+
+	cert := newTestCertificate(t, 42)
+	if err := fetcher.recordCertificate(cert); err != nil {
+		t.Fatalf("recordCertificate: %v", err)
+	}
+
+	certs, err := fetcher.ListManagedCertificates()
+	if err != nil {
+		t.Fatalf("ListManagedCertificates: %v", err)
+	}
+	if len(certs) != 1 {
+		t.Fatalf("expected 1 managed certificate, got %d: %v", len(certs), certs)
+	}
+	want := filepath.Join(dir, "certificates", cert.SerialNumber.String()+".pem")
+	if certs[0] != want {
+		t.Errorf("got %q, want %q", certs[0], want)
+	}
+}
+
+func TestListManagedCertificatesRequiresAccountStorage(t *testing.T) {
+	fetcher := NewCertFetcher()
+	if _, err := fetcher.ListManagedCertificates(); err == nil {
+		t.Error("expected an error without an AccountStorage configured")
+	}
+}